@@ -22,8 +22,6 @@ package main
 
 import (
 	"flag"
-	"image"
-	"image/color"
 	"log"
 	"net"
 	"os"
@@ -31,21 +29,24 @@ import (
 	"time"
 
 	"github.com/bradfitz/rfbgo/rfb"
+	"github.com/bradfitz/rfbgo/rfb/source/x11"
 )
 
 var (
 	listen  = flag.String("listen", ":5900", "listen on [ip]:port")
 	profile = flag.Bool("profile", false, "write a cpu.prof file when client disconnects")
-)
-
-const (
-	width  = 1280
-	height = 720
+	display = flag.String("display", "", "X11 display to capture (e.g. \":0\"); defaults to $DISPLAY")
 )
 
 func main() {
 	flag.Parse()
 
+	src, err := x11.Open(*display)
+	if err != nil {
+		log.Fatalf("opening X11 display: %v", err)
+	}
+	width, height := src.Dimensions()
+
 	ln, err := net.Listen("tcp", *listen)
 	if err != nil {
 		log.Fatal(err)
@@ -56,12 +57,15 @@ func main() {
 		err = s.Serve(ln)
 		log.Fatalf("rfb server ended with: %v", err)
 	}()
+	go func() {
+		log.Fatalf("x11 capture ended with: %v", src.Run(time.Second/30))
+	}()
 	for c := range s.Conns {
-		handleConn(c)
+		handleConn(src, c)
 	}
 }
 
-func handleConn(c *rfb.Conn) {
+func handleConn(src *x11.Source, c *rfb.Conn) {
 	if *profile {
 		f, err := os.Create("cpu.prof")
 		if err != nil {
@@ -76,54 +80,10 @@ func handleConn(c *rfb.Conn) {
 		defer log.Printf("stopping profiling CPU")
 	}
 
-	im := image.NewRGBA(image.Rect(0, 0, width, height))
-	li := &rfb.LockableImage{Img: im}
-
-	closec := make(chan bool)
-	go func() {
-		slide := 0
-		tick := time.NewTicker(time.Second / 30)
-		defer tick.Stop()
-		for {
-			select {
-			case <-closec:
-				return
-			case <-tick.C:
-				slide++
-				li.Lock()
-				drawImage(im, slide)
-				li.Unlock()
-				c.Feed <- li
-			}
-		}
-	}()
+	src.Attach(c)
 
 	for e := range c.Event {
 		log.Printf("got event: %#v", e)
 	}
-	close(closec)
 	log.Printf("Client disconnected")
 }
-
-func drawImage(im *image.RGBA, anim int) {
-	pos := 0
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			c := color.RGBA{uint8(x), uint8(y), uint8(x + y + anim), 0}
-			switch {
-			case x < (anim % 50):
-				c = color.RGBA{R: 255}
-			case x > width-50:
-				c = color.RGBA{G: 255}
-			case y < 50-(anim%50):
-				c = color.RGBA{R: 255, G: 255}
-			case y > height-50:
-				c = color.RGBA{B: 255}
-			}
-			im.Pix[pos] = c.R
-			im.Pix[pos+1] = c.G
-			im.Pix[pos+2] = c.B
-			pos += 4 // skipping alpha
-		}
-	}
-}
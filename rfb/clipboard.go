@@ -0,0 +1,160 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// maxExtendedClipboardText bounds the size of text we advertise (and
+// accept) through the extended-clipboard pseudo-encoding.
+const maxExtendedClipboardText = 20 << 20 // 20 MiB
+
+// maxExtendedClipboardPayload bounds the compressed payload we'll allocate
+// for before even decompressing it, so a client can't force a multi-
+// gigabyte allocation with a single 4-byte length field. Compressed data
+// larger than the uncompressed cap it's supposed to produce is already
+// bogus, so this reuses the same limit.
+const maxExtendedClipboardPayload = maxExtendedClipboardText
+
+// pushClipboard is pushFramesLoop's handler for SetClipboard. It's called
+// from the same goroutine as every other server-to-client message, so it
+// never interleaves with a framebuffer update mid-write.
+func (c *Conn) pushClipboard(text string) {
+	if c.wantsExtendedClipboard.Load() {
+		c.pushExtendedClipboard(text)
+		return
+	}
+	c.w(uint8(cmdServerCutText))
+	c.w(uint8(0)) // pad1
+	c.w(uint8(0)) // pad2
+	c.w(uint8(0)) // pad3
+	c.w(uint32(len(text)))
+	c.bw.WriteString(text)
+	c.flush()
+}
+
+func (c *Conn) pushBell() {
+	c.w(uint8(cmdBell))
+	c.flush()
+}
+
+// pushExtendedClipboardCaps announces, once per SetEncodings that newly
+// advertises pseudoEncodingExtendedClipboard, which formats and size
+// limits we support: just Text, up to maxExtendedClipboardText.
+func (c *Conn) pushExtendedClipboardCaps() {
+	c.writeExtendedClipboardMessage(extClipActionCaps|extClipFormatText, func(w io.Writer) error {
+		return binary.Write(w, binary.BigEndian, uint32(maxExtendedClipboardText))
+	})
+}
+
+// pushExtendedClipboard sends text as an extended-clipboard Provide
+// message (rfbproto's "extended clipboard" pseudo-encoding), which unlike
+// plain ServerCutText carries UTF-8 and isn't size-limited the way a
+// Latin-1 message effectively is.
+func (c *Conn) pushExtendedClipboard(text string) {
+	c.writeExtendedClipboardMessage(extClipActionProvide|extClipFormatText, func(w io.Writer) error {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(text))); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, text)
+		return err
+	})
+}
+
+// writeExtendedClipboardMessage writes a ServerCutText message in the
+// extended-clipboard form: a negative length, flags, then a zlib stream
+// built by writePayload.
+func (c *Conn) writeExtendedClipboardMessage(flags uint32, writePayload func(io.Writer) error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if err := writePayload(zw); err != nil {
+		c.failf("compressing extended clipboard message: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		c.failf("closing extended clipboard zlib stream: %v", err)
+	}
+
+	c.w(uint8(cmdServerCutText))
+	c.w(uint8(0)) // pad1
+	c.w(uint8(0)) // pad2
+	c.w(uint8(0)) // pad3
+	c.w(int32(-(4 + buf.Len())))
+	c.w(flags)
+	c.bw.Write(buf.Bytes())
+	c.flush()
+}
+
+// handleExtendedClientCutText reads the rest of an extended-clipboard
+// ClientCutText message (rfbproto §7.2's clipboard extension): n more
+// bytes, the first 4 of which are a flags word, the remainder a zlib
+// stream. Only the Provide action carrying Text is turned into a
+// ClientCutTextEvent; Caps/Request/Peek/Notify are read and discarded,
+// since this package has no outstanding clipboard request to answer.
+func (c *Conn) handleExtendedClientCutText(n int) {
+	if n < 4 {
+		c.failf("extended ClientCutText message too short: %d bytes", n)
+	}
+	if n-4 > maxExtendedClipboardPayload {
+		c.failf("extended ClientCutText payload too large: %d bytes", n-4)
+	}
+	var flags uint32
+	c.read("clientcuttext.ext.flags", &flags)
+
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.failf("reading extended ClientCutText payload: %v", err)
+	}
+
+	if flags&extClipActionProvide == 0 || flags&extClipFormatText == 0 {
+		return
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		c.failf("opening extended ClientCutText zlib stream: %v", err)
+	}
+	defer zr.Close()
+
+	var size uint32
+	if err := binary.Read(zr, binary.BigEndian, &size); err != nil {
+		c.failf("reading extended ClientCutText text size: %v", err)
+	}
+	if size > maxExtendedClipboardText {
+		c.failf("extended ClientCutText text too large: %d bytes", size)
+	}
+	text := make([]byte, size)
+	if _, err := io.ReadFull(zr, text); err != nil {
+		c.failf("reading extended ClientCutText text: %v", err)
+	}
+	c.Event <- ClientCutTextEvent{Text: string(text)}
+}
+
+// latin1ToUTF8 converts Latin-1 (ISO 8859-1) bytes, the classic
+// ClientCutText/ServerCutText charset, to a UTF-8 Go string. Latin-1's
+// code points 0-255 are exactly Unicode code points 0-255, so each byte
+// maps straight to a rune.
+func latin1ToUTF8(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import "image"
+
+// pushCursor is pushFramesLoop's handler for SetCursor. It sends the
+// Cursor pseudo-encoding (rfbproto §7.7.2): a rectangle whose x,y is the
+// hotspot and whose encoding-type data is the cursor's pixel data (in the
+// client's PixelFormat) followed by a 1-bit-per-pixel bitmask, each row
+// padded up to a whole byte.
+//
+// It's silently dropped if the client never advertised the Cursor
+// pseudo-encoding: there's no other way to deliver a cursor shape to it.
+func (c *Conn) pushCursor(cs cursorShape) {
+	if !c.wantsCursor.Load() {
+		return
+	}
+
+	b := cs.img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	c.w(uint8(cmdFramebufferUpdate))
+	c.w(uint8(0)) // padding byte
+	c.w(uint16(1))
+	c.w(uint16(cs.hotspot.X))
+	c.w(uint16(cs.hotspot.Y))
+	c.w(uint16(w))
+	c.w(uint16(h))
+	c.w(int32(pseudoEncodingCursor))
+	if w > 0 && h > 0 {
+		writeGenericPixels(c.bw, cs.img, b, c.format)
+		c.bw.Write(cursorBitmask(cs.img, b))
+	}
+	c.flush()
+}
+
+// cursorBitmask builds the Cursor pseudo-encoding's bitmask: one bit per
+// pixel (1 = opaque), most-significant bit first, each row padded to a
+// whole byte. A pixel counts as opaque if its alpha channel is non-zero.
+func cursorBitmask(im image.Image, b image.Rectangle) []byte {
+	w, h := b.Dx(), b.Dy()
+	rowBytes := (w + 7) / 8
+	mask := make([]byte, rowBytes*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			_, _, _, a := im.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			if a != 0 {
+				mask[y*rowBytes+x/8] |= 1 << uint(7-x%8)
+			}
+		}
+	}
+	return mask
+}
+
+// pushDesktopName is pushFramesLoop's handler for SetDesktopName. It sends
+// the DesktopName pseudo-encoding (rfbproto §7.7.4): a zero-sized
+// rectangle whose data is a length-prefixed UTF-8 name.
+//
+// It's silently dropped if the client never advertised the DesktopName
+// pseudo-encoding.
+func (c *Conn) pushDesktopName(name string) {
+	if !c.wantsDesktopName.Load() {
+		return
+	}
+
+	c.w(uint8(cmdFramebufferUpdate))
+	c.w(uint8(0)) // padding byte
+	c.w(uint16(1))
+	c.w(uint16(0)) // x
+	c.w(uint16(0)) // y
+	c.w(uint16(0)) // width
+	c.w(uint16(0)) // height
+	c.w(int32(pseudoEncodingDesktopName))
+	c.w(uint32(len(name)))
+	c.bw.WriteString(name)
+	c.flush()
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Encoding turns a rectangle of pixels into the wire format for one RFB
+// encoding type. Implementations may be stateful across calls (e.g. ZRLE's
+// persistent zlib stream): a Conn keeps one instance of each Encoding it
+// uses for its whole lifetime, rather than creating one per rectangle.
+type Encoding interface {
+	// Number is the RFB wire encoding-type number this Encoding
+	// implements (rfbproto §6.4.2, §7.7).
+	Number() int32
+
+	// Encode writes r's pixels of im, in format, to w. r is always a
+	// subset of im's bounds.
+	Encode(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error
+}
+
+// encodingRegistry maps an encoding number to a constructor for a fresh
+// Encoding instance. Register additional encodings with RegisterEncoding.
+var encodingRegistry = map[int32]func() Encoding{}
+
+// RegisterEncoding makes an Encoding available for negotiation with
+// clients that advertise support for it via SetEncodings. It's typically
+// called from an init function.
+func RegisterEncoding(number int32, newEncoding func() Encoding) {
+	encodingRegistry[number] = newEncoding
+}
+
+func init() {
+	RegisterEncoding(encodingRaw, func() Encoding { return new(rawEncoding) })
+}
+
+// rawEncoding implements Encoding for encodingRaw: pixels, uncompressed,
+// in the client's requested PixelFormat.
+type rawEncoding struct {
+	buf8 []uint8 // reused between calls to avoid generating garbage
+}
+
+func (e *rawEncoding) Number() int32 { return encodingRaw }
+
+func (e *rawEncoding) Encode(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error {
+	rgba, isRGBA := im.(*image.RGBA)
+	if isRGBA && format.isScreensThousands() && r == im.Bounds() {
+		e.writeRGBAScreensThousands(w, rgba, format)
+		return nil
+	}
+	return writeGenericPixels(w, im, r, format)
+}
+
+func (e *rawEncoding) writeRGBAScreensThousands(w io.Writer, im *image.RGBA, format PixelFormat) {
+	var u16 uint16
+	pixels := len(im.Pix) / 4
+	if len(e.buf8) < pixels*2 {
+		e.buf8 = make([]byte, pixels*2)
+	}
+	out := e.buf8[:]
+	isBigEndian := format.BigEndian != 0
+	for i, v8 := range im.Pix {
+		switch i % 4 {
+		case 0: // red
+			u16 = uint16(v8&248) << 7 // 3 masked bits + 7 shifted == redshift of 10
+		case 1: // green
+			u16 |= uint16(v8&248) << 2 // redshift of 5
+		case 2: // blue
+			u16 |= uint16(v8 >> 3)
+		case 3: // alpha, unused.  use this to just move the dest
+			hb, lb := uint8(u16>>8), uint8(u16)
+			if isBigEndian {
+				out[0] = hb
+				out[1] = lb
+			} else {
+				out[0] = lb
+				out[1] = hb
+			}
+			out = out[2:]
+		}
+	}
+	w.Write(e.buf8[:pixels*2])
+}
+
+// writeGenericPixels writes r's pixels of im, converted to format, one at
+// a time. It's the slow but always-correct path that works for any
+// image.Image and any client-requested pixel format; encoders that want
+// a faster path should special-case *image.RGBA themselves.
+func writeGenericPixels(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if err := writePixel(w, im.At(x, y), format); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pixelChannels converts col's RGBA channels into the client's pixel
+// format's red/green/blue ranges, without shifting them into place yet.
+func pixelChannels(col color.Color, format PixelFormat) (r16, g16, b16 uint32) {
+	cr, cg, cb, _ := col.RGBA()
+	return inRange(cr, format.RedMax), inRange(cg, format.GreenMax), inRange(cb, format.BlueMax)
+}
+
+// pixelValue returns col packed into format's bits, as a uint32 (callers
+// truncate to the right width for format.BPP).
+func pixelValue(col color.Color, format PixelFormat) uint32 {
+	r16, g16, b16 := pixelChannels(col, format)
+	return (r16 << format.RedShift) | (g16 << format.GreenShift) | (b16 << format.BlueShift)
+}
+
+func writePixel(w io.Writer, col color.Color, format PixelFormat) error {
+	return writeRawPixel(w, pixelValue(col, format), format)
+}
+
+// writeRawPixel writes an already-packed pixel value (e.g. a background
+// or subrect colour computed once and reused) in format's BPP and
+// byte order.
+func writeRawPixel(w io.Writer, u32 uint32, format PixelFormat) error {
+	var v interface{}
+	switch format.BPP {
+	case 32:
+		v = u32
+	case 16:
+		v = uint16(u32)
+	case 8:
+		v = uint8(u32)
+	default:
+		return fmt.Errorf("rfb: unsupported BPP %d", format.BPP)
+	}
+	order := binary.ByteOrder(binary.BigEndian)
+	if format.BigEndian == 0 {
+		order = binary.LittleEndian
+	}
+	return binary.Write(w, order, v)
+}
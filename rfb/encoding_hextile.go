@@ -0,0 +1,214 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"image"
+	"io"
+)
+
+const (
+	hextileTileSize = 16
+
+	hextileRaw              = 1
+	hextileBackgroundSpec   = 2
+	hextileForegroundSpec   = 4
+	hextileAnySubrects      = 8
+	hextileSubrectsColoured = 16
+)
+
+func init() {
+	RegisterEncoding(encodingHextile, func() Encoding { return new(hextileEncoding) })
+}
+
+// hextileEncoding implements Encoding for encodingHextile (rfbproto
+// §7.7.4): the rectangle is split into 16x16 tiles, each sent as either
+// raw pixels or a background colour plus a handful of subrects. It
+// remembers the previous tile's background across calls (within one
+// rectangle) so unchanged backgrounds don't need to be resent.
+type hextileEncoding struct {
+	havePrevBG bool
+	prevBG     uint32
+}
+
+func (e *hextileEncoding) Number() int32 { return encodingHextile }
+
+func (e *hextileEncoding) Encode(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error {
+	// Each rectangle starts its own run of tiles; the "reuse previous
+	// tile's background" rule only applies tile-to-tile within it.
+	e.havePrevBG = false
+
+	for ty := r.Min.Y; ty < r.Max.Y; ty += hextileTileSize {
+		th := hextileTileSize
+		if ty+th > r.Max.Y {
+			th = r.Max.Y - ty
+		}
+		for tx := r.Min.X; tx < r.Max.X; tx += hextileTileSize {
+			tw := hextileTileSize
+			if tx+tw > r.Max.X {
+				tw = r.Max.X - tx
+			}
+			tile := image.Rect(tx, ty, tx+tw, ty+th)
+			if err := e.encodeTile(w, im, tile, format); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *hextileEncoding) encodeTile(w io.Writer, im image.Image, tile image.Rectangle, format PixelFormat) error {
+	bg, fg, subrects, uniform := hextileAnalyzeTile(im, tile, format)
+
+	if !uniform {
+		// Not worth the bookkeeping: send it raw, same as the Raw
+		// encoding would, and forget any background we were tracking.
+		e.havePrevBG = false
+		if _, err := w.Write([]byte{hextileRaw}); err != nil {
+			return err
+		}
+		return writeGenericPixels(w, im, tile, format)
+	}
+
+	var mask uint8
+	sendBG := !e.havePrevBG || bg != e.prevBG
+	if sendBG {
+		mask |= hextileBackgroundSpec
+	}
+	coloured := hextileSubrectsNeedColour(subrects)
+	if len(subrects) > 0 {
+		mask |= hextileAnySubrects
+		if coloured {
+			mask |= hextileSubrectsColoured
+		} else {
+			mask |= hextileForegroundSpec
+		}
+	}
+
+	if _, err := w.Write([]byte{mask}); err != nil {
+		return err
+	}
+	if sendBG {
+		if err := writeRawPixel(w, bg, format); err != nil {
+			return err
+		}
+	}
+	e.havePrevBG, e.prevBG = true, bg
+
+	if mask&hextileForegroundSpec != 0 {
+		if err := writeRawPixel(w, fg, format); err != nil {
+			return err
+		}
+	}
+	if mask&hextileAnySubrects == 0 {
+		return nil
+	}
+	if _, err := w.Write([]byte{uint8(len(subrects))}); err != nil {
+		return err
+	}
+	for _, sr := range subrects {
+		if coloured {
+			if err := writeRawPixel(w, sr.pixel, format); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write([]byte{
+			uint8(sr.x<<4 | sr.y),
+			uint8((sr.w-1)<<4 | (sr.h - 1)),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type hextileSubrect struct {
+	pixel      uint32
+	x, y, w, h uint8 // tile-relative; w,h are 1..16
+}
+
+// hextileAnalyzeTile decides whether tile is worth encoding as
+// background+subrects at all (it isn't if it has too many distinct
+// colours to describe that way cheaply), and if so picks the background
+// (most frequent pixel), the foreground (most frequent non-background
+// pixel, used only when every subrect shares one colour), and the
+// subrects themselves as horizontal runs of non-background pixels.
+func hextileAnalyzeTile(im image.Image, tile image.Rectangle, format PixelFormat) (bg, fg uint32, subrects []hextileSubrect, uniform bool) {
+	w, h := tile.Dx(), tile.Dy()
+	values := make([]uint32, w*h)
+	freq := make(map[uint32]int)
+	i := 0
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			v := pixelValue(im.At(x, y), format)
+			values[i] = v
+			freq[v]++
+			i++
+		}
+	}
+	// Too many colours for a subrect list to be worthwhile; caller sends
+	// the tile raw instead.
+	if len(freq) > w*h/2+1 {
+		return 0, 0, nil, false
+	}
+
+	var bgCount int
+	for v, n := range freq {
+		if n > bgCount {
+			bgCount, bg = n, v
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		row := values[y*w : y*w+w]
+		for x := 0; x < w; {
+			v := row[x]
+			if v == bg {
+				x++
+				continue
+			}
+			start := x
+			for x < w && row[x] == v {
+				x++
+			}
+			subrects = append(subrects, hextileSubrect{
+				pixel: v,
+				x:     uint8(start),
+				y:     uint8(y),
+				w:     uint8(x - start),
+				h:     1,
+			})
+		}
+	}
+	if !hextileSubrectsNeedColour(subrects) && len(subrects) > 0 {
+		fg = subrects[0].pixel
+	}
+	return bg, fg, subrects, true
+}
+
+func hextileSubrectsNeedColour(subrects []hextileSubrect) bool {
+	if len(subrects) == 0 {
+		return false
+	}
+	first := subrects[0].pixel
+	for _, sr := range subrects[1:] {
+		if sr.pixel != first {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+func init() {
+	RegisterEncoding(encodingRRE, func() Encoding { return rreEncoding{} })
+}
+
+// rreEncoding implements Encoding for encodingRRE (rfbproto §7.7.2): a
+// background pixel plus a list of differently-coloured subrectangles.
+// It's a good fit for rectangles that are mostly one solid colour.
+type rreEncoding struct{}
+
+func (rreEncoding) Number() int32 { return encodingRRE }
+
+func (rreEncoding) Encode(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error {
+	bg, subrects := rreDecompose(im, r, format)
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(subrects))); err != nil {
+		return err
+	}
+	if err := writeRawPixel(w, bg, format); err != nil {
+		return err
+	}
+	for _, sr := range subrects {
+		if err := writeRawPixel(w, sr.pixel, format); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, [4]uint16{sr.x, sr.y, sr.w, sr.h}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rreSubrect struct {
+	pixel      uint32
+	x, y, w, h uint16
+}
+
+// rreDecompose picks r's most frequent pixel value as the background and
+// returns every maximal horizontal run of a different colour as a
+// subrectangle. It's not optimal (it doesn't try to merge runs vertically
+// into taller rectangles), but it's correct and cheap.
+func rreDecompose(im image.Image, r image.Rectangle, format PixelFormat) (bg uint32, subrects []rreSubrect) {
+	w, h := r.Dx(), r.Dy()
+	values := make([]uint32, w*h)
+	freq := make(map[uint32]int)
+	i := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := pixelValue(im.At(x, y), format)
+			values[i] = v
+			freq[v]++
+			i++
+		}
+	}
+
+	var bestCount int
+	for v, n := range freq {
+		if n > bestCount {
+			bestCount, bg = n, v
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		row := values[y*w : y*w+w]
+		for x := 0; x < w; {
+			v := row[x]
+			if v == bg {
+				x++
+				continue
+			}
+			start := x
+			for x < w && row[x] == v {
+				x++
+			}
+			subrects = append(subrects, rreSubrect{
+				pixel: v,
+				x:     uint16(start),
+				y:     uint16(y),
+				w:     uint16(x - start),
+				h:     1,
+			})
+		}
+	}
+	return bg, subrects
+}
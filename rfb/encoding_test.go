@@ -0,0 +1,142 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestInRange(t *testing.T) {
+	cases := []struct {
+		v    uint32
+		max  uint16
+		want uint32
+	}{
+		{0, 255, 0},
+		{0xffff, 255, 255},
+		{0x8000, 255, 127},
+		{0xffff, 0x1f, 31},
+		{0, 0x1f, 0},
+	}
+	for _, c := range cases {
+		if got := inRange(c.v, c.max); got != c.want {
+			t.Errorf("inRange(%#x, %d) = %d, want %d", c.v, c.max, got, c.want)
+		}
+	}
+}
+
+// truecolorFormat is the 32bpp/depth-24 truecolor PixelFormat that
+// virtually every real VNC client requests; it has the same 8-8-8 channel
+// layout as the server's own ServerInit default (rfb.go), which says 24
+// bits per pixel instead of 32. It's not the OS X "Screens Thousands"
+// 5-bit-per-channel format that inRange used to special-case.
+var truecolorFormat = PixelFormat{
+	BPP:        32,
+	Depth:      24,
+	BigEndian:  1,
+	TrueColour: 1,
+	RedMax:     255,
+	GreenMax:   255,
+	BlueMax:    255,
+	RedShift:   16,
+	GreenShift: 8,
+	BlueShift:  0,
+}
+
+// testImage returns a small image with a solid background and one
+// differently-coloured block, which is enough to exercise every
+// encoder's background/subrect (or palette/RLE) path.
+func testImage() *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			im.Set(x, y, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+		}
+	}
+	for y := 2; y < 6; y++ {
+		for x := 2; x < 10; x++ {
+			im.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+	return im
+}
+
+// TestRREEncode encodes a small image with RRE and checks the header's
+// background pixel and subrect count, and the total output length,
+// against what rreDecompose computed,
+// using the server's real truecolor PixelFormat rather than the 5-bit
+// Screens-Thousands one: this is the format that made inRange panic.
+func TestRREEncode(t *testing.T) {
+	im := testImage()
+	r := im.Bounds()
+
+	var buf bytes.Buffer
+	enc := rreEncoding{}
+	if err := enc.Encode(&buf, im, r, truecolorFormat); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	wantBG, wantSubrects := rreDecompose(im, r, truecolorFormat)
+
+	b := buf.Bytes()
+	if len(b) < 8 {
+		t.Fatalf("output too short: %d bytes", len(b))
+	}
+	gotNumSubrects := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	if int(gotNumSubrects) != len(wantSubrects) {
+		t.Errorf("num-subrects = %d, want %d", gotNumSubrects, len(wantSubrects))
+	}
+	gotBG := uint32(b[4])<<24 | uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])
+	if gotBG != wantBG {
+		t.Errorf("background pixel = %#x, want %#x", gotBG, wantBG)
+	}
+	wantLen := 8 + len(wantSubrects)*(4+8)
+	if len(b) != wantLen {
+		t.Errorf("output length = %d, want %d", len(b), wantLen)
+	}
+}
+
+// TestHextileEncode just checks that Encode succeeds and emits something,
+// using the server's real truecolor PixelFormat.
+func TestHextileEncode(t *testing.T) {
+	im := testImage()
+	var buf bytes.Buffer
+	enc := new(hextileEncoding)
+	if err := enc.Encode(&buf, im, im.Bounds(), truecolorFormat); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("Encode wrote no data")
+	}
+}
+
+// TestZRLEEncode just checks that Encode succeeds and emits something,
+// using the server's real truecolor PixelFormat.
+func TestZRLEEncode(t *testing.T) {
+	im := testImage()
+	var buf bytes.Buffer
+	enc := newZRLEEncoding()
+	if err := enc.Encode(&buf, im, im.Bounds(), truecolorFormat); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Fatal("Encode wrote no data")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+const (
+	zrleTileSize = 64
+
+	zrleSubencodingRaw      = 0
+	zrleSubencodingSolid    = 1
+	zrleSubencodingPlainRLE = 128
+
+	zrleMaxPaletteSize = 127
+)
+
+func init() {
+	RegisterEncoding(encodingZRLE, func() Encoding { return newZRLEEncoding() })
+}
+
+// zrleEncoding implements Encoding for encodingZRLE (rfbproto §7.7.7): the
+// rectangle is split into 64x64 tiles, each tile-encoded TRLE-style, and
+// the whole lot is deflated through one zlib stream that stays open for
+// the life of the Conn, so later rectangles benefit from the dictionary
+// built up by earlier ones.
+type zrleEncoding struct {
+	buf *bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func newZRLEEncoding() *zrleEncoding {
+	buf := new(bytes.Buffer)
+	return &zrleEncoding{buf: buf, zw: zlib.NewWriter(buf)}
+}
+
+func (e *zrleEncoding) Number() int32 { return encodingZRLE }
+
+func (e *zrleEncoding) Encode(w io.Writer, im image.Image, r image.Rectangle, format PixelFormat) error {
+	e.buf.Reset()
+
+	for ty := r.Min.Y; ty < r.Max.Y; ty += zrleTileSize {
+		th := zrleTileSize
+		if ty+th > r.Max.Y {
+			th = r.Max.Y - ty
+		}
+		for tx := r.Min.X; tx < r.Max.X; tx += zrleTileSize {
+			tw := zrleTileSize
+			if tx+tw > r.Max.X {
+				tw = r.Max.X - tx
+			}
+			tile := image.Rect(tx, ty, tx+tw, ty+th)
+			if err := e.encodeTile(e.zw, im, tile, format); err != nil {
+				return err
+			}
+		}
+	}
+	// Sync-flush (not Close!) so every byte of this rectangle reaches
+	// e.buf while keeping the compressor's dictionary alive for the next
+	// rectangle.
+	if err := e.zw.Flush(); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, uint32(e.buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+func (e *zrleEncoding) encodeTile(w io.Writer, im image.Image, tile image.Rectangle, format PixelFormat) error {
+	values, palette := zrleTileValues(im, tile, format)
+	runs := zrleRuns(values)
+
+	switch {
+	case len(palette) == 1:
+		if _, err := w.Write([]byte{zrleSubencodingSolid}); err != nil {
+			return err
+		}
+		return writeZRLEPixel(w, palette[0], format)
+
+	case len(palette) <= 16:
+		return zrleWritePackedPalette(w, tile, values, palette, format)
+
+	case len(runs) < len(values)/2 && len(palette) <= zrleMaxPaletteSize:
+		return zrleWritePaletteRLE(w, runs, palette, format)
+
+	case len(runs) < len(values)/2:
+		return zrleWritePlainRLE(w, runs, format)
+
+	default:
+		if _, err := w.Write([]byte{zrleSubencodingRaw}); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if err := writeZRLEPixel(w, v, format); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// zrleTileValues returns tile's pixels in row-major order, plus the
+// distinct values seen (in first-seen order, capped at
+// zrleMaxPaletteSize+1 — one past the point where a palette-based
+// encoding stops being worthwhile).
+func zrleTileValues(im image.Image, tile image.Rectangle, format PixelFormat) (values []uint32, palette []uint32) {
+	values = make([]uint32, 0, tile.Dx()*tile.Dy())
+	seen := make(map[uint32]int, 16)
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			v := pixelValue(im.At(x, y), format)
+			values = append(values, v)
+			if _, ok := seen[v]; !ok && len(palette) <= zrleMaxPaletteSize {
+				seen[v] = len(palette)
+				palette = append(palette, v)
+			}
+		}
+	}
+	return values, palette
+}
+
+type zrleRun struct {
+	value uint32
+	n     int
+}
+
+// zrleRuns run-length-encodes values, which may span tile row boundaries
+// (ZRLE treats a tile as one flat pixel sequence, unlike Hextile/RRE).
+func zrleRuns(values []uint32) []zrleRun {
+	var runs []zrleRun
+	for _, v := range values {
+		if n := len(runs); n > 0 && runs[n-1].value == v {
+			runs[n-1].n++
+			continue
+		}
+		runs = append(runs, zrleRun{value: v, n: 1})
+	}
+	return runs
+}
+
+func zrleWritePlainRLE(w io.Writer, runs []zrleRun, format PixelFormat) error {
+	if _, err := w.Write([]byte{zrleSubencodingPlainRLE}); err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if err := writeZRLEPixel(w, run.value, format); err != nil {
+			return err
+		}
+		if err := zrleWriteRunLength(w, run.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zrleWritePaletteRLE(w io.Writer, runs []zrleRun, palette []uint32, format PixelFormat) error {
+	// Subencoding 130-255: PaletteRLE, where subencoding-128 is the
+	// palette size.
+	if _, err := w.Write([]byte{uint8(128 + len(palette))}); err != nil {
+		return err
+	}
+	for _, v := range palette {
+		if err := writeZRLEPixel(w, v, format); err != nil {
+			return err
+		}
+	}
+	index := zrlePaletteIndex(palette)
+	for _, run := range runs {
+		i := index[run.value]
+		if run.n == 1 {
+			if _, err := w.Write([]byte{uint8(i)}); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write([]byte{uint8(i) | 0x80}); err != nil {
+			return err
+		}
+		if err := zrleWriteRunLength(w, run.n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zrleWritePackedPalette writes subencoding N (2-16, the palette size)
+// followed by the palette itself and, for each row, the pixel indices bit
+// packed at 1/2/4 bits depending on N, padded out to a byte at the end of
+// every row (rfbproto §7.7.7: "padded at the end of each row").
+func zrleWritePackedPalette(w io.Writer, tile image.Rectangle, values []uint32, palette []uint32, format PixelFormat) error {
+	n := len(palette)
+	if _, err := w.Write([]byte{uint8(n)}); err != nil {
+		return err
+	}
+	for _, v := range palette {
+		if err := writeZRLEPixel(w, v, format); err != nil {
+			return err
+		}
+	}
+
+	bits := 4
+	switch {
+	case n <= 2:
+		bits = 1
+	case n <= 4:
+		bits = 2
+	}
+	index := zrlePaletteIndex(palette)
+
+	width := tile.Dx()
+	for y := 0; y < tile.Dy(); y++ {
+		row := values[y*width : (y+1)*width]
+		var cur byte
+		var nbits int
+		for _, v := range row {
+			cur = cur<<uint(bits) | byte(index[v])
+			nbits += bits
+			if nbits == 8 {
+				if _, err := w.Write([]byte{cur}); err != nil {
+					return err
+				}
+				cur, nbits = 0, 0
+			}
+		}
+		if nbits > 0 {
+			cur <<= uint(8 - nbits)
+			if _, err := w.Write([]byte{cur}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func zrlePaletteIndex(palette []uint32) map[uint32]int {
+	m := make(map[uint32]int, len(palette))
+	for i, v := range palette {
+		m[v] = i
+	}
+	return m
+}
+
+// zrleWriteRunLength writes n-1 (a ZRLE run always has n>=1) as a
+// sequence of 255s followed by a final byte, per rfbproto §7.7.7.
+func zrleWriteRunLength(w io.Writer, n int) error {
+	for n > 255 {
+		if _, err := w.Write([]byte{255}); err != nil {
+			return err
+		}
+		n -= 255
+	}
+	_, err := w.Write([]byte{byte(n - 1)})
+	return err
+}
+
+// isCPixelFormat reports whether format qualifies for ZRLE's compact
+// 3-byte CPIXEL form: 32bpp/depth-24 true colour with 8 bits per channel.
+func isCPixelFormat(format PixelFormat) bool {
+	return format.BPP == 32 && format.Depth == 24 &&
+		format.RedMax == 255 && format.GreenMax == 255 && format.BlueMax == 255
+}
+
+// writeZRLEPixel writes a packed pixel value in CPIXEL form when the
+// client's format allows it, or full-width otherwise.
+func writeZRLEPixel(w io.Writer, v uint32, format PixelFormat) error {
+	if !isCPixelFormat(format) {
+		return writeRawPixel(w, v, format)
+	}
+	var buf [4]byte
+	if format.BigEndian != 0 {
+		binary.BigEndian.PutUint32(buf[:], v)
+		_, err := w.Write(buf[1:4])
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[:], v)
+	_, err := w.Write(buf[0:3])
+	return err
+}
@@ -0,0 +1,861 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rfb implements enough of the RFB (VNC) protocol to act as a
+// server: feed it images and it'll speak RFB to whatever client connects.
+//
+// Protocol docs:
+//
+//	http://www.realvnc.com/docs/rfbproto.pdf
+//
+// Author: Brad Fitzpatrick <brad@danga.com>
+package rfb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	v3 = "RFB 003.003\n"
+	v7 = "RFB 003.007\n"
+	v8 = "RFB 003.008\n"
+
+	authNone     = 1
+	authVNC      = 2
+	authVeNCrypt = 19
+
+	statusOK     = 0
+	statusFailed = 1
+
+	encodingRaw      = 0
+	encodingCopyRect = 1
+	encodingRRE      = 2
+	encodingHextile  = 5
+	encodingZRLE     = 16
+
+	// Pseudo-encodings: advertised by the client in SetEncodings like
+	// real encodings, but they don't describe rectangle pixel data.
+	pseudoEncodingDesktopSize       = -223
+	pseudoEncodingCursor            = -239
+	pseudoEncodingDesktopName       = -307
+	pseudoEncodingExtendedClipboard = -1063
+
+	// Client -> Server
+	cmdSetPixelFormat           = 0
+	cmdSetEncodings             = 2
+	cmdFramebufferUpdateRequest = 3
+	cmdKeyEvent                 = 4
+	cmdPointerEvent             = 5
+	cmdClientCutText            = 6
+
+	// Server -> Client
+	cmdFramebufferUpdate = 0
+	cmdBell              = 2
+	cmdServerCutText     = 3
+
+	// Extended clipboard (pseudoEncodingExtendedClipboard) format bits,
+	// packed into the low 24 bits of its flags word.
+	extClipFormatText = 1 << 0
+
+	// Extended clipboard action bits, packed into the high 8 bits of its
+	// flags word.
+	extClipActionCaps    = 1 << 24
+	extClipActionRequest = 1 << 25
+	extClipActionPeek    = 1 << 26
+	extClipActionNotify  = 1 << 27
+	extClipActionProvide = 1 << 28
+
+	// maxClientCutText bounds the plain (non-extended) ClientCutText text
+	// we'll allocate for, so a client can't force a multi-gigabyte
+	// allocation with a single 4-byte length field.
+	maxClientCutText = 20 << 20 // 20 MiB
+)
+
+// LockableImage is an image.Image paired with a mutex, so a producer can
+// keep mutating it in place (e.g. redrawing a desktop) while a Conn is in
+// the middle of encoding and sending its current contents.
+type LockableImage struct {
+	sync.Mutex
+	Img image.Image
+}
+
+// Server accepts RFB client connections and hands each negotiated Conn
+// to the caller over Conns.
+type Server struct {
+	// Conns receives a *Conn for each client as soon as it's accepted,
+	// before the RFB handshake has necessarily completed. Callers should
+	// range over it and, for each Conn, send images on Conn.Feed and
+	// receive input events from Conn.Event.
+	Conns chan *Conn
+
+	width, height int
+
+	security []SecurityHandler
+}
+
+// NewServer returns a Server that will advertise a desktop of the given
+// dimensions to clients.
+func NewServer(width, height int) *Server {
+	return &Server{
+		Conns:  make(chan *Conn),
+		width:  width,
+		height: height,
+	}
+}
+
+// SetSecurity configures the security (authentication) types a Server
+// offers to clients, in preference order. With no call to SetSecurity, a
+// Server offers only NoAuth.
+func (s *Server) SetSecurity(handlers []SecurityHandler) {
+	s.security = handlers
+}
+
+// securityHandlers returns the configured security handlers, or the
+// NoAuth default if none were set.
+func (s *Server) securityHandlers() []SecurityHandler {
+	if len(s.security) == 0 {
+		return []SecurityHandler{NoAuth{}}
+	}
+	return s.security
+}
+
+// Serve accepts connections on ln until Accept returns an error, which it
+// then returns. Each accepted connection is handed off to its own
+// goroutine and, once constructed, published on s.Conns.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		conn := s.newConn(c)
+		go conn.serve()
+		s.Conns <- conn
+	}
+}
+
+// Conn is a single client's RFB connection.
+type Conn struct {
+	s  *Server
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	fbupc  chan FrameBufferUpdateRequest
+	closec chan struct{} // never sent; just closed when serve returns
+
+	// should only be mutated once during handshake, but then
+	// only read.
+	format PixelFormat
+
+	// Feed is how callers push new framebuffer contents to the client.
+	// Sending a *LockableImage replaces the image sent on the next
+	// update.
+	Feed chan *LockableImage
+
+	feedRects chan rectsUpdate // see FeedRects
+
+	clipboardc   chan string      // see SetClipboard
+	bellc        chan bool        // see Bell; never sent a meaningful value, just a wakeup
+	capsc        chan bool        // wakeup: push an extended-clipboard Caps message
+	cursorc      chan cursorShape // see SetCursor
+	desktopNamec chan string      // see SetDesktopName
+
+	// Event delivers client input (KeyEvent, PointerEvent, and
+	// ClientCutTextEvent values) to the caller.
+	Event chan interface{}
+
+	mu   sync.RWMutex // guards last (but not its pixels, just the variable)
+	last *LockableImage
+
+	// encodings is the client's SetEncodings list, in the preference
+	// order it sent them. It's set by handleSetEncodings (the serve
+	// goroutine) and read by pickEncoding (pushFramesLoop), hence the
+	// atomic.Pointer rather than a plain slice field. encoders caches one
+	// Encoding instance per negotiated encoding number for the lifetime of
+	// the Conn, since some (e.g. ZRLE) carry state across rectangles; it's
+	// only ever touched from pushFramesLoop, so it needs no lock.
+	encodings atomic.Pointer[[]int32]
+	encoders  map[int32]Encoding
+
+	// wantsDesktopSize, wantsExtendedClipboard, wantsCursor and
+	// wantsDesktopName are set by handleSetEncodings (the serve goroutine)
+	// and read by pushFramesLoop (a different goroutine), hence
+	// atomic.Bool rather than plain bool.
+	wantsDesktopSize       atomic.Bool // client advertised pseudoEncodingDesktopSize
+	wantsExtendedClipboard atomic.Bool // client advertised pseudoEncodingExtendedClipboard
+	wantsCursor            atomic.Bool // client advertised pseudoEncodingCursor
+	wantsDesktopName       atomic.Bool // client advertised pseudoEncodingDesktopName
+
+	sentWidth  int // dimensions last advertised to the client; pushFramesLoop-goroutine-only
+	sentHeight int
+}
+
+func (s *Server) newConn(c net.Conn) *Conn {
+	return &Conn{
+		s:            s,
+		c:            c,
+		br:           bufio.NewReader(c),
+		bw:           bufio.NewWriter(c),
+		fbupc:        make(chan FrameBufferUpdateRequest, 128),
+		Feed:         make(chan *LockableImage, 10),
+		feedRects:    make(chan rectsUpdate, 10),
+		clipboardc:   make(chan string, 4),
+		bellc:        make(chan bool, 4),
+		capsc:        make(chan bool, 1),
+		cursorc:      make(chan cursorShape, 4),
+		desktopNamec: make(chan string, 4),
+		Event:        make(chan interface{}, 16),
+		closec:       make(chan struct{}),
+		encoders:     make(map[int32]Encoding),
+	}
+}
+
+// rectsUpdate is sent on Conn.feedRects by FeedRects.
+type rectsUpdate struct {
+	rects []image.Rectangle
+	li    *LockableImage
+}
+
+// FeedRects is like sending on Feed, except only the given rectangles of
+// li (in li's own coordinate space) are re-sent to the client, instead of
+// the whole framebuffer. Callers that know which regions of the desktop
+// actually changed (e.g. from an X11 DAMAGE event) should prefer this over
+// Feed to avoid re-encoding and re-sending unchanged pixels.
+func (c *Conn) FeedRects(rects []image.Rectangle, li *LockableImage) {
+	c.feedRects <- rectsUpdate{rects: rects, li: li}
+}
+
+// TryFeedRects is like FeedRects, except it reports false instead of
+// blocking forever if c's client has already disconnected. Callers that
+// fan one capture out to many Conns (e.g. rfb/source/x11) should use this
+// so one dead client doesn't wedge frame delivery to the rest.
+func (c *Conn) TryFeedRects(rects []image.Rectangle, li *LockableImage) bool {
+	select {
+	case c.feedRects <- rectsUpdate{rects: rects, li: li}:
+		return true
+	case <-c.closec:
+		return false
+	}
+}
+
+// Done returns a channel that's closed once this Conn's client has
+// disconnected (or its connection has otherwise failed). Callers that
+// push frames from their own goroutine (e.g. rfb/source/x11) should
+// select on Done alongside Feed/FeedRects sends so a dead Conn doesn't
+// block them forever.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closec
+}
+
+// ClientCutTextEvent is delivered on Conn.Event when the client's
+// clipboard changes.
+//
+// 6.4.6
+type ClientCutTextEvent struct {
+	Text string
+}
+
+// SetClipboard pushes text to the client as its new clipboard contents
+// (a ServerCutText message, or the extended-clipboard equivalent if the
+// client advertised pseudoEncodingExtendedClipboard). It's serialized
+// through the same loop as framebuffer updates, so it never interleaves
+// with one mid-message.
+func (c *Conn) SetClipboard(text string) {
+	c.clipboardc <- text
+}
+
+// Bell rings the client's bell.
+func (c *Conn) Bell() {
+	c.bellc <- true
+}
+
+// cursorShape is sent on Conn.cursorc by SetCursor.
+type cursorShape struct {
+	img     image.Image
+	hotspot image.Point
+}
+
+// SetCursor pushes a new cursor shape to the client, with hotspot giving
+// the pixel within img (in img's own coordinate space) that tracks the
+// pointer position. It's a no-op if the client never advertised the
+// Cursor pseudo-encoding, since there's no other way to draw a cursor for
+// it: the caller is expected to composite the pointer into its
+// framebuffer image as a fallback in that case.
+func (c *Conn) SetCursor(img image.Image, hotspot image.Point) {
+	c.cursorc <- cursorShape{img: img, hotspot: hotspot}
+}
+
+// SetDesktopName pushes a new desktop name to the client. It's a no-op if
+// the client never advertised the DesktopName pseudo-encoding.
+func (c *Conn) SetDesktopName(name string) {
+	c.desktopNamec <- name
+}
+
+func (c *Conn) dimensions() (w, h int) {
+	return c.s.width, c.s.height
+}
+
+func (c *Conn) readByte(what string) byte {
+	b, err := c.br.ReadByte()
+	if err != nil {
+		c.failf("reading client byte for %q: %v", what, err)
+	}
+	return b
+}
+
+func (c *Conn) readPadding(what string, size int) {
+	for i := 0; i < size; i++ {
+		c.readByte(what)
+	}
+}
+
+func (c *Conn) read(what string, v interface{}) {
+	err := binary.Read(c.br, binary.BigEndian, v)
+	if err != nil {
+		c.failf("reading from client into %T for %q: %v", v, what, err)
+	}
+}
+
+func (c *Conn) w(v interface{}) {
+	binary.Write(c.bw, binary.BigEndian, v)
+}
+
+func (c *Conn) flush() {
+	c.bw.Flush()
+}
+
+// sendSecurityResult writes the 6.1.3 SecurityResult message. For
+// statusFailed under RFB 3.8, reason is sent as the UTF-8 failure-reason
+// string the spec added in that version; earlier versions have no room
+// for one and the caller shouldn't send this message to them at all.
+func (c *Conn) sendSecurityResult(status uint32, reason string) {
+	c.w(status)
+	if status == statusFailed {
+		c.w(uint32(len(reason)))
+		c.bw.WriteString(reason)
+	}
+	c.flush()
+}
+
+func (c *Conn) failf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (c *Conn) serve() {
+	defer c.c.Close()
+	defer close(c.fbupc)
+	defer close(c.closec)
+	defer close(c.Event)
+	defer func() {
+		e := recover()
+		if e != nil {
+			log.Printf("rfb: client disconnect: %v", e)
+		}
+	}()
+
+	c.bw.WriteString(v8)
+	c.flush()
+	sl, err := c.br.ReadSlice('\n')
+	if err != nil {
+		c.failf("reading client protocol version: %v", err)
+	}
+	ver := string(sl)
+	log.Printf("rfb: client wants: %q", ver)
+	switch ver {
+	case v3, v7, v8: // cool.
+	default:
+		c.failf("bogus client-requested protocol version %q", ver)
+	}
+
+	// 6.1.2. Security
+	handlers := c.s.securityHandlers()
+	var chosen SecurityHandler
+	if ver >= v7 {
+		c.w(uint8(len(handlers)))
+		for _, h := range handlers {
+			c.w(h.SecurityType())
+		}
+		c.flush()
+		wanted := c.readByte("6.1.2:client requested security-type")
+		for _, h := range handlers {
+			if h.SecurityType() == wanted {
+				chosen = h
+				break
+			}
+		}
+		if chosen == nil {
+			c.failf("client wanted unsupported security type %d", int(wanted))
+		}
+	} else {
+		// Old way: the server unilaterally picks.
+		chosen = handlers[0]
+		c.w(uint32(chosen.SecurityType()))
+		c.flush()
+	}
+
+	authErr := chosen.Authenticate(c)
+
+	if ver >= v8 {
+		// 6.1.3. SecurityResult
+		if authErr != nil {
+			c.sendSecurityResult(statusFailed, authErr.Error())
+		} else {
+			c.sendSecurityResult(statusOK, "")
+		}
+	}
+	if authErr != nil {
+		c.failf("authentication failed: %v", authErr)
+	}
+
+	// ClientInit
+	wantShared := c.readByte("shared-flag") != 0
+	_ = wantShared
+
+	c.format = PixelFormat{
+		BPP:        24,
+		Depth:      24,
+		BigEndian:  1,
+		TrueColour: 1,
+		RedMax:     255,
+		GreenMax:   255,
+		BlueMax:    255,
+		RedShift:   16,
+		GreenShift: 8,
+		BlueShift:  0,
+	}
+
+	// 6.3.2. ServerInit
+	width, height := c.dimensions()
+	c.sentWidth, c.sentHeight = width, height
+	c.w(uint16(width))
+	c.w(uint16(height))
+	c.w(c.format.BPP)
+	c.w(c.format.Depth)
+	c.w(c.format.BigEndian)
+	c.w(c.format.TrueColour)
+	c.w(c.format.RedMax)
+	c.w(c.format.GreenMax)
+	c.w(c.format.BlueMax)
+	c.w(c.format.RedShift)
+	c.w(c.format.GreenShift)
+	c.w(c.format.BlueShift)
+	c.w(uint8(0)) // pad1
+	c.w(uint8(0)) // pad2
+	c.w(uint8(0)) // pad3
+	serverName := "rfb-go"
+	c.w(int32(len(serverName)))
+	c.bw.WriteString(serverName)
+	c.flush()
+
+	go c.pushFramesLoop()
+	for {
+		cmd := c.readByte("6.4:client-server-packet-type")
+		switch cmd {
+		case cmdSetPixelFormat:
+			c.handleSetPixelFormat()
+		case cmdSetEncodings:
+			c.handleSetEncodings()
+		case cmdFramebufferUpdateRequest:
+			c.handleUpdateRequest()
+		case cmdPointerEvent:
+			c.handlePointerEvent()
+		case cmdKeyEvent:
+			c.handleKeyEvent()
+		case cmdClientCutText:
+			c.handleClientCutText()
+		default:
+			c.failf("unsupported command type %d from client", int(cmd))
+		}
+	}
+}
+
+func (c *Conn) pushFramesLoop() {
+	// pushFramesLoop runs in its own goroutine (started from serve, which
+	// has its own recover), so a failf from a write to a client that hung
+	// up mid-frame needs its own recover here too, or it'd crash the whole
+	// process instead of just this client's connection.
+	defer func() {
+		e := recover()
+		if e != nil {
+			log.Printf("rfb: client disconnect (push): %v", e)
+		}
+	}()
+	for {
+		select {
+		case ur, ok := <-c.fbupc:
+			if !ok {
+				// Client disconnected.
+				return
+			}
+			c.pushFrame(ur)
+		case li := <-c.Feed:
+			c.mu.Lock()
+			c.last = li
+			c.mu.Unlock()
+			c.pushImage(li)
+		case ru, ok := <-c.feedRects:
+			if !ok {
+				return
+			}
+			c.mu.Lock()
+			c.last = ru.li
+			c.mu.Unlock()
+			c.pushImageRects(ru.li, ru.rects)
+		case text, ok := <-c.clipboardc:
+			if !ok {
+				return
+			}
+			c.pushClipboard(text)
+		case _, ok := <-c.bellc:
+			if !ok {
+				return
+			}
+			c.pushBell()
+		case _, ok := <-c.capsc:
+			if !ok {
+				return
+			}
+			c.pushExtendedClipboardCaps()
+		case cs, ok := <-c.cursorc:
+			if !ok {
+				return
+			}
+			c.pushCursor(cs)
+		case name, ok := <-c.desktopNamec:
+			if !ok {
+				return
+			}
+			c.pushDesktopName(name)
+		}
+	}
+}
+
+func (c *Conn) pushFrame(ur FrameBufferUpdateRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	li := c.last
+	if li == nil {
+		return
+	}
+
+	if ur.incremental() {
+		li.Lock()
+		defer li.Unlock()
+		im := li.Img
+		b := im.Bounds()
+		width, height := b.Dx(), b.Dy()
+
+		c.w(uint8(cmdFramebufferUpdate))
+		c.w(uint8(0))      // padding byte
+		c.w(uint16(1))     // no rectangles
+		c.w(uint16(0))     // x
+		c.w(uint16(0))     // y
+		c.w(uint16(width)) // x
+		c.w(uint16(height))
+		c.w(int32(encodingCopyRect))
+		c.w(uint16(0)) // src-x
+		c.w(uint16(0)) // src-y
+		c.flush()
+		return
+	}
+	c.pushImage(li)
+}
+
+func (c *Conn) pushImage(li *LockableImage) {
+	li.Lock()
+	defer li.Unlock()
+
+	im := li.Img
+	b := im.Bounds()
+	if b.Min.X != 0 || b.Min.Y != 0 {
+		panic("this code is lazy and assumes images with Min bounds at 0,0")
+	}
+
+	resizeRect, resized := c.desktopResizeRectLocked(b.Dx(), b.Dy())
+	numRects := uint16(1)
+	if resized {
+		numRects++
+	}
+	c.w(uint8(cmdFramebufferUpdate))
+	c.w(uint8(0)) // padding byte
+	c.w(numRects)
+	if resized {
+		c.pushDesktopSizeRectLocked(resizeRect)
+	}
+	c.pushRectLocked(im, b)
+	c.flush()
+}
+
+// pushImageRects sends only the given rectangles of li, instead of its
+// full bounds. It's the implementation behind FeedRects.
+func (c *Conn) pushImageRects(li *LockableImage, rects []image.Rectangle) {
+	li.Lock()
+	defer li.Unlock()
+
+	if len(rects) == 0 {
+		return
+	}
+	im := li.Img
+	b := im.Bounds()
+	resizeRect, resized := c.desktopResizeRectLocked(b.Dx(), b.Dy())
+	numRects := uint16(len(rects))
+	if resized {
+		numRects++
+	}
+	c.w(uint8(cmdFramebufferUpdate))
+	c.w(uint8(0)) // padding byte
+	c.w(numRects)
+	if resized {
+		c.pushDesktopSizeRectLocked(resizeRect)
+	}
+	for _, r := range rects {
+		c.pushRectLocked(im, r.Intersect(b))
+	}
+	c.flush()
+}
+
+// desktopResizeRectLocked reports whether the framebuffer's dimensions
+// have changed since they were last advertised to a client that asked for
+// the DesktopSize pseudo-encoding, returning the synthetic rectangle to
+// send if so.
+func (c *Conn) desktopResizeRectLocked(w, h int) (image.Rectangle, bool) {
+	if !c.wantsDesktopSize.Load() || (w == c.sentWidth && h == c.sentHeight) {
+		return image.Rectangle{}, false
+	}
+	c.sentWidth, c.sentHeight = w, h
+	return image.Rect(0, 0, w, h), true
+}
+
+// pushDesktopSizeRectLocked writes the DesktopSize pseudo-encoding
+// rectangle: a header with no pixel data, telling the client the
+// framebuffer is now r's size.
+func (c *Conn) pushDesktopSizeRectLocked(r image.Rectangle) {
+	c.w(uint16(r.Min.X))
+	c.w(uint16(r.Min.Y))
+	c.w(uint16(r.Dx()))
+	c.w(uint16(r.Dy()))
+	c.w(int32(pseudoEncodingDesktopSize))
+}
+
+// pushRectLocked writes one rectangle (header + pixel data) of im, in the
+// client's best mutually-supported encoding. Callers must hold im's lock.
+func (c *Conn) pushRectLocked(im image.Image, r image.Rectangle) {
+	if c.format.TrueColour == 0 {
+		c.failf("only true-colour supported")
+	}
+
+	enc := c.pickEncoding()
+	c.w(uint16(r.Min.X))
+	c.w(uint16(r.Min.Y))
+	c.w(uint16(r.Dx()))
+	c.w(uint16(r.Dy()))
+	c.w(int32(enc.Number()))
+	if err := enc.Encode(c.bw, im, r, c.format); err != nil {
+		c.failf("encoding rect as %T: %v", enc, err)
+	}
+}
+
+type PixelFormat struct {
+	BPP, Depth                      uint8
+	BigEndian, TrueColour           uint8 // flags; 0 or non-zero
+	RedMax, GreenMax, BlueMax       uint16
+	RedShift, GreenShift, BlueShift uint8
+}
+
+// Is the format requested by the OS X "Screens" app's "Thousands" mode.
+func (f *PixelFormat) isScreensThousands() bool {
+	return f.BPP == 16 && f.Depth == 16 && f.TrueColour != 0 &&
+		f.RedMax == 0x1f && f.GreenMax == 0x1f && f.BlueMax == 0x1f &&
+		f.RedShift == 10 && f.GreenShift == 5 && f.BlueShift == 0
+}
+
+// 6.4.1
+func (c *Conn) handleSetPixelFormat() {
+	c.readPadding("SetPixelFormat padding", 3)
+	var pf PixelFormat
+	c.read("pixelformat.bpp", &pf.BPP)
+	c.read("pixelformat.depth", &pf.Depth)
+	c.read("pixelformat.beflag", &pf.BigEndian)
+	c.read("pixelformat.truecolour", &pf.TrueColour)
+	c.read("pixelformat.redmax", &pf.RedMax)
+	c.read("pixelformat.greenmax", &pf.GreenMax)
+	c.read("pixelformat.bluemax", &pf.BlueMax)
+	c.read("pixelformat.redshift", &pf.RedShift)
+	c.read("pixelformat.greenshift", &pf.GreenShift)
+	c.read("pixelformat.blueshift", &pf.BlueShift)
+	c.readPadding("SetPixelFormat pixel format padding", 3)
+	log.Printf("rfb: client wants pixel format: %#v", pf)
+	c.format = pf
+}
+
+// 6.4.2
+func (c *Conn) handleSetEncodings() {
+	c.readPadding("SetEncodings padding", 1)
+
+	var numEncodings uint16
+	c.read("6.4.2:number-of-encodings", &numEncodings)
+	encType := make([]int32, 0, numEncodings)
+	for i := 0; i < int(numEncodings); i++ {
+		var t int32
+		c.read("encoding-type", &t)
+		encType = append(encType, t)
+	}
+	log.Printf("rfb: client encodings: %#v", encType)
+	c.encodings.Store(&encType)
+
+	wantsDesktopSize := false
+	wantsExtendedClipboard := false
+	wantsCursor := false
+	wantsDesktopName := false
+	for _, t := range encType {
+		switch t {
+		case pseudoEncodingDesktopSize:
+			wantsDesktopSize = true
+		case pseudoEncodingExtendedClipboard:
+			wantsExtendedClipboard = true
+		case pseudoEncodingCursor:
+			wantsCursor = true
+		case pseudoEncodingDesktopName:
+			wantsDesktopName = true
+		}
+	}
+	c.wantsDesktopSize.Store(wantsDesktopSize)
+	c.wantsCursor.Store(wantsCursor)
+	c.wantsDesktopName.Store(wantsDesktopName)
+	hadExtendedClipboard := c.wantsExtendedClipboard.Swap(wantsExtendedClipboard)
+	if wantsExtendedClipboard && !hadExtendedClipboard {
+		// Tell pushFramesLoop to announce our extended-clipboard
+		// capabilities (format/size limits) before we rely on them.
+		select {
+		case c.capsc <- true:
+		default:
+		}
+	}
+}
+
+// pickEncoding returns the client's most-preferred encoding that we have
+// an Encoding registered for, reusing (and creating, if needed) the
+// per-Conn instance that holds that encoding's state. It always succeeds:
+// encodingRaw has no prerequisites and every client is assumed to accept it.
+func (c *Conn) pickEncoding() Encoding {
+	encodings := c.encodings.Load()
+	if encodings == nil {
+		return c.encoderFor(encodingRaw, encodingRegistry[encodingRaw])
+	}
+	for _, num := range *encodings {
+		if newEncoding, ok := encodingRegistry[num]; ok {
+			return c.encoderFor(num, newEncoding)
+		}
+	}
+	return c.encoderFor(encodingRaw, encodingRegistry[encodingRaw])
+}
+
+func (c *Conn) encoderFor(num int32, newEncoding func() Encoding) Encoding {
+	if enc, ok := c.encoders[num]; ok {
+		return enc
+	}
+	enc := newEncoding()
+	c.encoders[num] = enc
+	return enc
+}
+
+// 6.4.3
+type FrameBufferUpdateRequest struct {
+	IncrementalFlag     uint8
+	X, Y, Width, Height uint16
+}
+
+func (r *FrameBufferUpdateRequest) incremental() bool { return r.IncrementalFlag != 0 }
+
+// 6.4.3
+func (c *Conn) handleUpdateRequest() {
+	var req FrameBufferUpdateRequest
+	c.read("framebuffer-update.incremental", &req.IncrementalFlag)
+	c.read("framebuffer-update.x", &req.X)
+	c.read("framebuffer-update.y", &req.Y)
+	c.read("framebuffer-update.width", &req.Width)
+	c.read("framebuffer-update.height", &req.Height)
+	c.fbupc <- req
+}
+
+// KeyEvent is delivered on Conn.Event for each key press or release.
+//
+// 6.4.4
+type KeyEvent struct {
+	DownFlag uint8
+	Key      uint32
+}
+
+// 6.4.4
+func (c *Conn) handleKeyEvent() {
+	var req KeyEvent
+	c.read("key-event.downflag", &req.DownFlag)
+	c.readPadding("key-event.padding", 2)
+	c.read("key-event.key", &req.Key)
+	c.Event <- req
+}
+
+// PointerEvent is delivered on Conn.Event for each pointer movement or
+// button change.
+//
+// 6.4.5
+type PointerEvent struct {
+	ButtonMask uint8
+	X, Y       uint16
+}
+
+// 6.4.5
+func (c *Conn) handlePointerEvent() {
+	var req PointerEvent
+	c.read("pointer-event.mask", &req.ButtonMask)
+	c.read("pointer-event.x", &req.X)
+	c.read("pointer-event.y", &req.Y)
+	c.Event <- req
+}
+
+// 6.4.6
+func (c *Conn) handleClientCutText() {
+	c.readPadding("ClientCutText padding", 3)
+	var length int32
+	c.read("clientcuttext.length", &length)
+	if length < 0 {
+		c.handleExtendedClientCutText(int(-length))
+		return
+	}
+	if length > maxClientCutText {
+		c.failf("ClientCutText text too large: %d bytes", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(c.br, buf); err != nil {
+		c.failf("reading ClientCutText text: %v", err)
+	}
+	c.Event <- ClientCutTextEvent{Text: latin1ToUTF8(buf)}
+}
+
+// inRange scales a color.Color channel value v (as returned by RGBA, i.e.
+// 0-0xffff) down into the client's PixelFormat range 0-max.
+func inRange(v uint32, max uint16) uint32 {
+	return v * uint32(max) / 0xffff
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfb
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+)
+
+// VeNCryptSubtype identifies one of the VeNCrypt sub-types negotiated
+// after a client picks SecurityType 19. The "X509" sub-types differ from
+// their "TLS" counterparts only in what the client is expected to do with
+// the server's certificate (verify it against a CA vs. accept it
+// anonymously); the server-side handshake is identical, so VeNCrypt
+// offers both for whichever of TLS-with-no-further-auth or
+// TLS-then-VNC-Authentication it's configured for.
+type VeNCryptSubtype uint32
+
+const (
+	VeNCryptTLSNone  VeNCryptSubtype = 257
+	VeNCryptTLSVnc   VeNCryptSubtype = 258
+	VeNCryptX509None VeNCryptSubtype = 260
+	VeNCryptX509Vnc  VeNCryptSubtype = 261
+)
+
+// VeNCrypt implements SecurityType 19 (VeNCrypt): it upgrades the
+// connection to TLS using TLSConfig, then optionally runs Inner's
+// handshake over the now-encrypted connection.
+type VeNCrypt struct {
+	// TLSConfig configures the TLS server handshake.
+	TLSConfig *tls.Config
+
+	// Inner, if non-nil, is run over the TLS connection once it's
+	// established, and the TLSVnc/X509Vnc sub-types are offered. If
+	// nil, only TLSNone/X509None are offered, and a client that
+	// completes the TLS handshake is admitted with no further auth.
+	Inner SecurityHandler
+}
+
+func (VeNCrypt) SecurityType() uint8 { return authVeNCrypt }
+
+func (v VeNCrypt) Authenticate(c *Conn) error {
+	c.w(uint8(0)) // VeNCrypt major version we speak
+	c.w(uint8(2)) // VeNCrypt minor version we speak
+	c.flush()
+
+	major := c.readByte("vencrypt.client-major")
+	minor := c.readByte("vencrypt.client-minor")
+	if major != 0 {
+		c.w(uint8(1)) // version not supported
+		c.flush()
+		return fmt.Errorf("rfb: client wants VeNCrypt %d.%d, only 0.x supported", major, minor)
+	}
+	c.w(uint8(0)) // version ack
+	c.flush()
+
+	subtypes := v.offeredSubtypes()
+	c.w(uint8(len(subtypes)))
+	for _, st := range subtypes {
+		c.w(uint32(st))
+	}
+	c.flush()
+
+	var chosen uint32
+	c.read("vencrypt.chosen-subtype", &chosen)
+
+	wantInner, ok := v.subtypeWantsInner(VeNCryptSubtype(chosen))
+	if !ok {
+		return fmt.Errorf("rfb: client chose unoffered VeNCrypt sub-type %d", chosen)
+	}
+
+	tlsConn := tls.Server(c.c, v.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("rfb: VeNCrypt TLS handshake: %v", err)
+	}
+	c.c = tlsConn
+	c.br = bufio.NewReader(tlsConn)
+	c.bw = bufio.NewWriter(tlsConn)
+
+	if wantInner {
+		return v.Inner.Authenticate(c)
+	}
+	return nil
+}
+
+func (v VeNCrypt) offeredSubtypes() []VeNCryptSubtype {
+	if v.Inner == nil {
+		return []VeNCryptSubtype{VeNCryptTLSNone, VeNCryptX509None}
+	}
+	return []VeNCryptSubtype{VeNCryptTLSVnc, VeNCryptX509Vnc}
+}
+
+func (v VeNCrypt) subtypeWantsInner(st VeNCryptSubtype) (wantInner, ok bool) {
+	for _, offered := range v.offeredSubtypes() {
+		if offered == st {
+			return v.Inner != nil, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package x11
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// DAMAGE extension sub-opcodes (damageproto.h).
+const (
+	damageQueryVersion = 0
+	damageCreate       = 1
+	damageSubtract     = 3
+
+	damageReportDeltaRectangles = 1
+)
+
+var errNoDamageExtension = errors.New("x11: DAMAGE extension not available")
+
+// damageExt tracks the state needed to receive incremental repaint
+// notifications via the X DAMAGE extension, instead of polling the whole
+// root window on a timer.
+type damageExt struct {
+	s           *Source
+	majorOpcode uint8
+	eventBase   uint8
+	damageID    uint32
+
+	rectc chan []image.Rectangle
+}
+
+// openDamageExtension queries for and, if present, initializes the DAMAGE
+// extension against s's root window. It returns errNoDamageExtension if
+// the X server doesn't have it.
+func openDamageExtension(s *Source) (*damageExt, error) {
+	present, majorOpcode, eventBase, err := s.queryExtension("DAMAGE")
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, errNoDamageExtension
+	}
+
+	d := &damageExt{
+		s:           s,
+		majorOpcode: majorOpcode,
+		eventBase:   eventBase,
+		rectc:       make(chan []image.Rectangle, 64),
+	}
+
+	if _, err := s.extensionRequest(majorOpcode, damageQueryVersion, func(w *reqWriter) {
+		w.u32(1) // client major version
+		w.u32(1) // client minor version
+	}); err != nil {
+		return nil, fmt.Errorf("x11: DamageQueryVersion: %v", err)
+	}
+
+	d.damageID = s.allocID()
+	if _, err := s.extensionRequest(majorOpcode, damageCreate, func(w *reqWriter) {
+		w.u32(d.damageID)
+		w.u32(s.root)
+		w.u8(damageReportDeltaRectangles)
+		w.pad(3)
+	}); err != nil {
+		return nil, fmt.Errorf("x11: DamageCreate: %v", err)
+	}
+
+	go d.readEvents()
+	return d, nil
+}
+
+// rects returns the channel on which newly-damaged rectangles (in root
+// window coordinates) are delivered.
+func (d *damageExt) rects() <-chan []image.Rectangle {
+	return d.rectc
+}
+
+// readEvents drains s.eventc for DamageNotify events, forwarding the
+// damaged rectangle on rectc and subtracting the damage region so the
+// server will report the next change.
+func (d *damageExt) readEvents() {
+	defer close(d.rectc)
+	for ev := range d.s.eventc {
+		if ev[0]&0x7f != d.eventBase {
+			continue // not ours
+		}
+		// DamageNotify (damageproto.h xDamageNotifyEvent): level(1),
+		// seq(2), drawable(4), damage(4), timestamp(4), area rect(8),
+		// geometry rect(8).
+		area := image.Rect(
+			int(int16(binary.BigEndian.Uint16(ev[16:18]))),
+			int(int16(binary.BigEndian.Uint16(ev[18:20]))),
+			0, 0,
+		)
+		w := int(binary.BigEndian.Uint16(ev[20:22]))
+		h := int(binary.BigEndian.Uint16(ev[22:24]))
+		area.Max = area.Min.Add(image.Pt(w, h))
+
+		d.rectc <- []image.Rectangle{area}
+
+		if _, err := d.s.extensionRequest(d.majorOpcode, damageSubtract, func(w *reqWriter) {
+			w.u32(d.damageID)
+			w.u32(0) // repair: None
+			w.u32(0) // parts: None
+		}); err != nil {
+			return
+		}
+	}
+}
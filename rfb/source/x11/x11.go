@@ -0,0 +1,600 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package x11 captures the root window of a local X11 display and feeds
+// it to an rfb.Conn, so the RFB server can act as a read-only VNC view
+// onto a real X session instead of a synthetic test pattern.
+//
+// It speaks just enough of the X11 protocol to do the connection setup,
+// issue GetImage requests against the root window, and (if available)
+// subscribe to the DAMAGE extension so it only needs to re-fetch the
+// rectangles that actually changed.
+package x11
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/rfbgo/rfb"
+)
+
+const (
+	byteOrderMSBFirst = 0x42 // 'B'
+	byteOrderLSBFirst = 0x6c // 'l'
+
+	protoMajorVersion = 11
+	protoMinorVersion = 0
+
+	opCodeGetImage       = 73
+	opCodeQueryExtension = 98
+
+	imageFormatZPixmap = 2
+)
+
+// Source captures the root window of an X11 display and pushes frames
+// into one or more rfb.Conns.
+type Source struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	byteOrder binary.ByteOrder
+
+	root           uint32
+	depth          uint8
+	width          uint16
+	height         uint16
+	resourceIDBase uint32
+	resourceIDMask uint32
+	nextResourceID uint32
+
+	// replyc and eventc are fed by readLoop, which is the sole reader of
+	// c once it starts: replies (and errors) go to replyc, everything
+	// else (e.g. DamageNotify) goes to eventc.
+	replyc chan []byte
+	eventc chan []byte
+
+	// reqMu serializes request/reply round trips (extensionRequest,
+	// queryExtension, getImageInto) across goroutines: damageExt.readEvents
+	// and Run's polling/damage loop both issue requests on the same
+	// connection, and without this lock one goroutine's request bytes
+	// could interleave with another's on bw, or a reply meant for one
+	// could be delivered to the other waiting on replyc.
+	reqMu sync.Mutex
+
+	damage *damageExt // nil if the DAMAGE extension isn't available
+
+	mu    sync.Mutex
+	conns []*rfb.Conn
+}
+
+// Open connects to the X11 display named by the $DISPLAY-style string
+// (e.g. ":0", "localhost:0.0"). An empty display uses $DISPLAY.
+func Open(display string) (*Source, error) {
+	if display == "" {
+		display = os.Getenv("DISPLAY")
+	}
+	network, addr, screen, err := parseDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("x11: dialing display %q: %v", display, err)
+	}
+	s := &Source{
+		c:  c,
+		br: bufio.NewReader(c),
+		bw: bufio.NewWriter(c),
+	}
+	if err := s.safeHandshake(screen); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	s.replyc = make(chan []byte, 4)
+	s.eventc = make(chan []byte, 64)
+	go s.readLoop()
+
+	s.damage, err = openDamageExtension(s)
+	if err != nil {
+		// Not fatal: we just fall back to polling.
+		s.damage = nil
+	}
+	return s, nil
+}
+
+// readLoop is the sole reader of s.c once started. It demultiplexes the
+// X11 byte stream into replies/errors (sent to replyc, one per request)
+// and events (sent to eventc, e.g. DamageNotify).
+func (s *Source) readLoop() {
+	defer close(s.replyc)
+	defer close(s.eventc)
+	for {
+		hdr := make([]byte, 32)
+		if _, err := readFull(s.br, hdr); err != nil {
+			return
+		}
+		switch {
+		case hdr[0] == 0: // error: bytes 4-7 are error-specific, not a length
+			s.replyc <- hdr
+		case hdr[0] == 1: // reply: bytes 4-7 are the reply's length, in 4-byte units
+			extra := binary.BigEndian.Uint32(hdr[4:8]) * 4
+			if extra > 0 {
+				body := make([]byte, extra)
+				if _, err := readFull(s.br, body); err != nil {
+					return
+				}
+				hdr = append(hdr, body...)
+			}
+			s.replyc <- hdr
+		default: // event
+			s.eventc <- hdr
+		}
+	}
+}
+
+// allocID returns a fresh X11 resource ID in this client's allocated
+// range (section 2.3 of the protocol spec).
+func (s *Source) allocID() uint32 {
+	id := s.resourceIDBase | (s.nextResourceID & s.resourceIDMask)
+	s.nextResourceID++
+	return id
+}
+
+// reqWriter accumulates the body of an extension request (the bytes
+// after the 4-byte opcode/length header).
+type reqWriter struct {
+	order binary.ByteOrder
+	buf   []byte
+}
+
+func (w *reqWriter) u8(v uint8) { w.buf = append(w.buf, v) }
+func (w *reqWriter) pad(n int)  { w.buf = append(w.buf, make([]byte, n)...) }
+func (w *reqWriter) u32(v uint32) {
+	var b [4]byte
+	w.order.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+// extensionRequest sends an extension request (major opcode from
+// QueryExtension, extension-defined minor opcode) with a body built by
+// fill, and waits for its reply.
+func (s *Source) extensionRequest(majorOpcode, minorOpcode uint8, fill func(*reqWriter)) ([]byte, error) {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+
+	w := &reqWriter{order: s.byteOrder}
+	fill(w)
+	// Body must be padded to a multiple of 4 bytes.
+	w.pad(pad(len(w.buf)))
+
+	s.bw.WriteByte(majorOpcode)
+	s.bw.WriteByte(minorOpcode)
+	s.w(uint16(1 + len(w.buf)/4)) // request length, in 4-byte units
+	s.bw.Write(w.buf)
+	s.flush()
+
+	reply, ok := <-s.replyc
+	if !ok {
+		return nil, fmt.Errorf("x11: connection closed waiting for reply")
+	}
+	if reply[0] == 0 {
+		return nil, fmt.Errorf("x11: error response (code %d) to extension request %d/%d", reply[1], majorOpcode, minorOpcode)
+	}
+	return reply, nil
+}
+
+// queryExtension asks the X server whether the named extension is
+// present, returning its major opcode and first event code if so.
+func (s *Source) queryExtension(name string) (present bool, majorOpcode, firstEvent uint8, err error) {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+
+	s.bw.WriteByte(opCodeQueryExtension)
+	s.bw.WriteByte(0) // unused
+	reqLen := uint16(2 + (len(name)+pad(len(name)))/4)
+	s.w(reqLen)
+	s.w(uint16(len(name)))
+	s.w(uint16(0)) // unused
+	s.bw.WriteString(name)
+	s.bw.Write(make([]byte, pad(len(name))))
+	s.flush()
+
+	reply, ok := <-s.replyc
+	if !ok {
+		return false, 0, 0, fmt.Errorf("x11: connection closed waiting for QueryExtension reply")
+	}
+	if reply[0] == 0 {
+		return false, 0, 0, fmt.Errorf("x11: error response (code %d) to QueryExtension", reply[1])
+	}
+	return reply[8] != 0, reply[9], reply[10], nil
+}
+
+// parseDisplay turns a $DISPLAY-style string into a dial network/address
+// and a screen number, e.g. ":1" -> ("unix", "/tmp/.X11-unix/X1", 0).
+func parseDisplay(display string) (network, addr string, screen int, err error) {
+	if display == "" {
+		return "", "", 0, fmt.Errorf("x11: no display specified and $DISPLAY is unset")
+	}
+	host := display
+	screenStr := "0"
+	if i := strings.LastIndex(display, ":"); i != -1 {
+		host, screenStr = display[:i], display[i+1:]
+	}
+	num := screenStr
+	if i := strings.Index(screenStr, "."); i != -1 {
+		num, screenStr = screenStr[:i], screenStr[i+1:]
+		screen, err = strconv.Atoi(screenStr)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("x11: bad display %q: %v", display, err)
+		}
+	}
+	if host == "" {
+		return "unix", "/tmp/.X11-unix/X" + num, screen, nil
+	}
+	port, err := strconv.Atoi(num)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("x11: bad display %q: %v", display, err)
+	}
+	return "tcp", fmt.Sprintf("%s:%d", host, 6000+port), screen, nil
+}
+
+// safeHandshake runs handshake, recovering the panics that its s.read/
+// s.readByte/s.readFull/s.skip helpers raise on I/O errors. handshake runs
+// synchronously from Open, before readLoop's recover-free goroutine even
+// exists, so without this a truncated or torn-down connection-setup reply
+// would crash the whole process instead of Open returning an error as its
+// signature promises.
+func (s *Source) safeHandshake(screen int) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("x11: connection setup: %v", e)
+		}
+	}()
+	return s.handshake(screen)
+}
+
+// handshake performs the X11 connection setup (protocol chapter 8) and
+// records the root window, depth, and dimensions of the requested screen.
+func (s *Source) handshake(screen int) error {
+	s.bw.WriteByte(byteOrderMSBFirst)
+	s.bw.WriteByte(0) // unused
+	s.byteOrder = binary.BigEndian
+	s.w(uint16(protoMajorVersion))
+	s.w(uint16(protoMinorVersion))
+	s.w(uint16(0)) // authorization-protocol-name length
+	s.w(uint16(0)) // authorization-protocol-data length
+	s.w(uint16(0)) // unused
+	s.flush()
+
+	success := s.readByte()
+	var reasonLen uint8
+	s.read(&reasonLen)
+	var major, minor uint16
+	s.read(&major)
+	s.read(&minor)
+	var replyLen uint16
+	s.read(&replyLen)
+	if success != 1 {
+		reason := make([]byte, reasonLen)
+		s.readFull(reason)
+		s.skip(pad(int(reasonLen)))
+		return fmt.Errorf("x11: connection setup refused: %s", reason)
+	}
+
+	var releaseNumber, ridBase, ridMask, motionBufferSize uint32
+	s.read(&releaseNumber)
+	s.read(&ridBase)
+	s.read(&ridMask)
+	s.read(&motionBufferSize)
+	var vendorLen uint16
+	s.read(&vendorLen)
+	var maxRequestLen uint16
+	s.read(&maxRequestLen)
+	var numScreens, numFormats uint8
+	s.read(&numScreens)
+	s.read(&numFormats)
+	s.skip(1 + 1 + 1 + 1 + 1 + 1 + 4) // imageByteOrder, bitmapBitOrder, scanlineUnit, scanlinePad, minKeycode, maxKeycode, unused
+	s.skip(int(vendorLen))
+	s.skip(pad(int(vendorLen)))
+	s.skip(8 * int(numFormats)) // PIXMAP-FORMAT list
+
+	s.resourceIDBase = ridBase
+	s.resourceIDMask = ridMask
+	s.nextResourceID = 1
+
+	for i := 0; i < int(numScreens); i++ {
+		var root, colormap, whitePixel, blackPixel, inputMask uint32
+		s.read(&root)
+		s.read(&colormap)
+		s.read(&whitePixel)
+		s.read(&blackPixel)
+		s.read(&inputMask)
+		var width, height uint16
+		s.read(&width)
+		s.read(&height)
+		s.skip(2 + 2) // width/height in millimeters
+		var minMaps, maxMaps uint16
+		s.read(&minMaps)
+		s.read(&maxMaps)
+		var rootVisual uint32
+		s.read(&rootVisual)
+		var backingStore, saveUnders, rootDepth uint8
+		s.read(&backingStore)
+		s.read(&saveUnders)
+		s.read(&rootDepth)
+		var numDepths uint8
+		s.read(&numDepths)
+		for d := 0; d < int(numDepths); d++ {
+			var depth, unused1 uint8
+			var numVisuals uint16
+			var unused2 uint32
+			s.read(&depth)
+			s.read(&unused1)
+			s.read(&numVisuals)
+			s.read(&unused2)
+			s.skip(24 * int(numVisuals)) // VISUALTYPE list
+		}
+		if i == screen {
+			s.root = root
+			s.depth = rootDepth
+			s.width = width
+			s.height = height
+		}
+	}
+	if s.root == 0 {
+		return fmt.Errorf("x11: screen %d not found", screen)
+	}
+	return nil
+}
+
+// Dimensions returns the captured root window's size.
+func (s *Source) Dimensions() (w, h int) {
+	return int(s.width), int(s.height)
+}
+
+// Close closes the connection to the X server.
+func (s *Source) Close() error {
+	return s.c.Close()
+}
+
+// Attach registers c to receive frames captured by s. Each call to Run
+// feeds the most recently captured image to every attached Conn, via
+// FeedRects when only part of the desktop changed.
+func (s *Source) Attach(c *rfb.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns = append(s.conns, c)
+}
+
+// Run captures frames and pushes them to every attached Conn. Without
+// DAMAGE it re-fetches and sends the whole frame every interval. With
+// DAMAGE it sends just the rectangles that changed as they are reported,
+// and in addition still re-fetches and sends the whole frame every
+// interval. It runs until the process exits or the X11 connection fails;
+// callers typically run it in its own goroutine.
+func (s *Source) Run(interval time.Duration) error {
+	im := image.NewRGBA(image.Rect(0, 0, int(s.width), int(s.height)))
+	li := &rfb.LockableImage{Img: im}
+
+	if s.damage != nil {
+		return s.runDamage(li, interval)
+	}
+	return s.runPoll(li, interval)
+}
+
+// runPoll unconditionally re-fetches and re-sends the whole framebuffer
+// every interval. It's the fallback used when DAMAGE isn't available.
+func (s *Source) runPoll(li *rfb.LockableImage, interval time.Duration) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		li.Lock()
+		err := s.getImageInto(li.Img.(*image.RGBA), s.fullRect())
+		li.Unlock()
+		if err != nil {
+			return err
+		}
+		s.feed(li)
+	}
+	return nil
+}
+
+// runDamage waits for DAMAGE notifications and only re-fetches the
+// rectangles reported dirty, falling back to a full repaint at interval
+// in case an event was dropped.
+func (s *Source) runDamage(li *rfb.LockableImage, interval time.Duration) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	rectc := s.damage.rects()
+	for {
+		select {
+		case rects, ok := <-rectc:
+			if !ok {
+				return fmt.Errorf("x11: DAMAGE event stream closed")
+			}
+			li.Lock()
+			for _, r := range rects {
+				if err := s.getImageInto(li.Img.(*image.RGBA), r); err != nil {
+					li.Unlock()
+					return err
+				}
+			}
+			li.Unlock()
+			s.feedRects(rects, li)
+		case <-tick.C:
+			li.Lock()
+			err := s.getImageInto(li.Img.(*image.RGBA), s.fullRect())
+			li.Unlock()
+			if err != nil {
+				return err
+			}
+			s.feed(li)
+		}
+	}
+}
+
+func (s *Source) fullRect() image.Rectangle {
+	return image.Rect(0, 0, int(s.width), int(s.height))
+}
+
+// feed pushes li to every attached Conn, dropping (and forgetting) any
+// whose client has disconnected instead of blocking on them: otherwise a
+// single dead Conn's full, undrained Feed channel would wedge delivery to
+// every other attached Conn too, since this runs under s.mu.
+func (s *Source) feed(li *rfb.LockableImage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.conns[:0]
+	for _, c := range s.conns {
+		select {
+		case c.Feed <- li:
+			live = append(live, c)
+		case <-c.Done():
+			// client disconnected; drop it
+		}
+	}
+	s.conns = live
+}
+
+// feedRects is feed's FeedRects counterpart; see feed's comment.
+func (s *Source) feedRects(rects []image.Rectangle, li *rfb.LockableImage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.conns[:0]
+	for _, c := range s.conns {
+		if c.TryFeedRects(rects, li) {
+			live = append(live, c)
+		}
+	}
+	s.conns = live
+}
+
+// getImageInto issues a GetImage request for r against the root window
+// and decodes the ZPixmap reply into dst at r's offset.
+func (s *Source) getImageInto(dst *image.RGBA, r image.Rectangle) error {
+	r = r.Intersect(s.fullRect())
+	if r.Empty() {
+		return nil
+	}
+
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+
+	s.bw.WriteByte(opCodeGetImage)
+	s.bw.WriteByte(imageFormatZPixmap)
+	reqLen := uint16(5) // in 4-byte units: header(1) + drawable(1) + x,y(1) + w,h(1) + plane-mask(1)
+	s.w(reqLen)
+	s.w(s.root)
+	s.w(int16(r.Min.X))
+	s.w(int16(r.Min.Y))
+	s.w(uint16(r.Dx()))
+	s.w(uint16(r.Dy()))
+	s.w(uint32(0xffffffff)) // plane-mask: all planes
+	s.flush()
+
+	reply, ok := <-s.replyc
+	if !ok {
+		return fmt.Errorf("x11: connection closed waiting for GetImage reply")
+	}
+	if reply[0] == 0 {
+		return fmt.Errorf("x11: error response (code %d) to GetImage", reply[1])
+	}
+	body := reply[32:]
+
+	bytesPerPixel := 4 // ZPixmap at depth 24/32 is packed 4-byte BGRX/BGRA on the wire
+	stride := r.Dx() * bytesPerPixel
+	for y := 0; y < r.Dy(); y++ {
+		row := body[y*stride : y*stride+stride]
+		for x := 0; x < r.Dx(); x++ {
+			px := row[x*bytesPerPixel : x*bytesPerPixel+bytesPerPixel]
+			i := dst.PixOffset(r.Min.X+x, r.Min.Y+y)
+			dst.Pix[i+0] = px[2] // R
+			dst.Pix[i+1] = px[1] // G
+			dst.Pix[i+2] = px[0] // B
+			dst.Pix[i+3] = 0xff  // A
+		}
+	}
+	return nil
+}
+
+// -- small serialization helpers, mirroring the style of the rfb package --
+
+func (s *Source) w(v interface{}) {
+	binary.Write(s.bw, s.byteOrder, v)
+}
+
+func (s *Source) read(v interface{}) {
+	if err := binary.Read(s.br, s.byteOrder, v); err != nil {
+		panic(fmt.Sprintf("x11: reading %T: %v", v, err))
+	}
+}
+
+func (s *Source) readByte() uint8 {
+	b, err := s.br.ReadByte()
+	if err != nil {
+		panic(fmt.Sprintf("x11: reading byte: %v", err))
+	}
+	return b
+}
+
+func (s *Source) readFull(buf []byte) {
+	if _, err := readFull(s.br, buf); err != nil {
+		panic(fmt.Sprintf("x11: reading %d bytes: %v", len(buf), err))
+	}
+}
+
+func (s *Source) skip(n int) {
+	if n <= 0 {
+		return
+	}
+	buf := make([]byte, n)
+	s.readFull(buf)
+}
+
+func (s *Source) flush() {
+	s.bw.Flush()
+}
+
+func readFull(r interface{ Read([]byte) (int, error) }, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// pad returns the number of padding bytes needed to round n up to a
+// multiple of 4, as required between variable-length fields in the X11
+// wire protocol.
+func pad(n int) int {
+	return (4 - n%4) % 4
+}